@@ -0,0 +1,378 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultGitProtocol = "https"
+)
+
+var errEmptyConfig = fmt.Errorf("empty config file")
+
+// Config is the in-memory representation of a user's gh configuration,
+// backed by the YAML documents for config.yml and hosts.yml.
+type Config struct {
+	root      *yaml.Node
+	hostsRoot *yaml.Node
+	path      string
+}
+
+// ReadConfigFile and WriteConfigFile are declared as vars so that tests can
+// substitute in-memory stand-ins instead of touching the filesystem.
+var ReadConfigFile = func(fn string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteConfigFile writes atomically: data lands in fn.tmp first, then is
+// renamed into place, so a crash or failure mid-write can never leave fn
+// holding a partial document.
+var WriteConfigFile = func(fn string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0771); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// maxConfigBackups caps how many rotated backups BackupConfigFile keeps, as
+// fn.bak.1 (most recent) through fn.bak.N (oldest).
+const maxConfigBackups = 3
+
+// BackupConfigFile copies fn to fn.bak.1 before it's overwritten, rotating
+// up to maxConfigBackups prior backups rather than clobbering a single one.
+// It copies fn rather than moving it, so fn itself is left in place
+// regardless of whether the caller's own rewrite of it subsequently
+// succeeds or fails.
+var BackupConfigFile = func(fn string) error {
+	oldest := fmt.Sprintf("%s.bak.%d", fn, maxConfigBackups)
+	if _, err := os.Stat(oldest); err == nil {
+		if err := os.Remove(oldest); err != nil {
+			return err
+		}
+	}
+	for i := maxConfigBackups - 1; i >= 1; i-- {
+		src := fmt.Sprintf("%s.bak.%d", fn, i)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := os.Rename(src, fmt.Sprintf("%s.bak.%d", fn, i+1)); err != nil {
+			return err
+		}
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn+".bak.1", data, 0600)
+}
+
+// StubWriteConfig redirects config writes into in-memory buffers for the
+// duration of a test.
+func StubWriteConfig(mainBuffer, hostsBuffer io.Writer) func() {
+	orig := WriteConfigFile
+	WriteConfigFile = func(fn string, data []byte) (err error) {
+		if strings.HasSuffix(fn, "hosts.yml") {
+			_, err = hostsBuffer.Write(data)
+		} else {
+			_, err = mainBuffer.Write(data)
+		}
+		return
+	}
+	return func() {
+		WriteConfigFile = orig
+	}
+}
+
+// StubBackupConfig disables the config backup step for the duration of a test.
+func StubBackupConfig() func() {
+	orig := BackupConfigFile
+	BackupConfigFile = func(string) error { return nil }
+	return func() {
+		BackupConfigFile = orig
+	}
+}
+
+func blankRoot() *yaml.Node {
+	return &yaml.Node{
+		Kind: yaml.DocumentNode,
+		Content: []*yaml.Node{
+			{Kind: yaml.MappingNode},
+		},
+	}
+}
+
+func parseConfigData(data []byte) (*yaml.Node, error) {
+	if len(data) == 0 {
+		return nil, errEmptyConfig
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 {
+		return blankRoot(), nil
+	}
+	if root.Content[0].Kind != yaml.MappingNode {
+		return &root, fmt.Errorf("expected a top level map")
+	}
+	return &root, nil
+}
+
+// readRawConfigFile reads and parses fn but, unlike parseConfigFile, does not
+// resolve its include: directive: the returned root is exactly what fn
+// itself contains. Used ahead of schema migrations (see migrations.go),
+// which must read and write the document a user actually owns rather than
+// an include-resolved merge of it and whatever it pulls in.
+func readRawConfigFile(fn string) ([]byte, *yaml.Node, error) {
+	data, err := ReadConfigFile(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := parseConfigData(data)
+	if err != nil {
+		return data, nil, err
+	}
+	return data, root, nil
+}
+
+func parseConfigFile(fn string) ([]byte, *yaml.Node, error) {
+	data, root, err := readRawConfigFile(fn)
+	if err != nil {
+		return data, nil, err
+	}
+	root, err = resolveIncludes(fn, root, map[string]bool{filepath.Clean(fn): true}, 0, false)
+	if err != nil {
+		return data, nil, err
+	}
+	return data, root, nil
+}
+
+// rawRootOrBlank parses fn without resolving includes (see
+// readRawConfigFile), treating a missing or empty file as an absent one
+// rather than an error.
+func rawRootOrBlank(fn string) (*yaml.Node, error) {
+	_, root, err := readRawConfigFile(fn)
+	if err != nil {
+		if err == errEmptyConfig || os.IsNotExist(err) {
+			return blankRoot(), nil
+		}
+		return nil, err
+	}
+	return root, nil
+}
+
+func hostsConfigFile(fn string) string {
+	return filepath.Join(filepath.Dir(fn), "hosts.yml")
+}
+
+func findEntry(mapNode *yaml.Node, key string) (*yaml.Node, error) {
+	if mapNode == nil {
+		return nil, fmt.Errorf("not found: %q", key)
+	}
+	for i := 0; i+1 < len(mapNode.Content); i += 2 {
+		if mapNode.Content[i].Value == key {
+			return mapNode.Content[i+1], nil
+		}
+	}
+	return nil, fmt.Errorf("not found: %q", key)
+}
+
+func removeEntry(mapNode *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapNode.Content); i += 2 {
+		if mapNode.Content[i].Value == key {
+			mapNode.Content = append(mapNode.Content[:i], mapNode.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+func forceString(mapNode *yaml.Node, key string) {
+	if v, err := findEntry(mapNode, key); err == nil {
+		v.Tag = "!!str"
+	}
+}
+
+// migrateConfig pulls the legacy "host: [ {user, oauth_token} ]" shape out of
+// mainRoot and returns a mapping fragment of the hosts it found. This is the
+// original config.yml layout from before hosts.yml was split out.
+func migrateConfig(mainRoot *yaml.Node) (*yaml.Node, bool, error) {
+	mainMap := mainRoot.Content[0]
+	fragment := &yaml.Node{Kind: yaml.MappingNode}
+	migrated := false
+
+	for i := 0; i+1 < len(mainMap.Content); {
+		key := mainMap.Content[i]
+		val := mainMap.Content[i+1]
+		if val.Kind != yaml.SequenceNode || len(val.Content) != 1 || val.Content[0].Kind != yaml.MappingNode {
+			i += 2
+			continue
+		}
+		hostMap := val.Content[0]
+		forceString(hostMap, "oauth_token")
+		fragment.Content = append(fragment.Content, key, hostMap)
+		mainMap.Content = append(mainMap.Content[:i], mainMap.Content[i+2:]...)
+		migrated = true
+	}
+
+	return fragment, migrated, nil
+}
+
+// parseConfig reads config.yml (fn) and its companion hosts.yml, running any
+// pending schema migrations (see migrations.go) against the raw documents
+// before their include: directives are resolved, and folding any inline
+// "hosts:" block into the hosts document.
+func parseConfig(fn string) (*Config, error) {
+	rawMainRoot, err := rawRootOrBlank(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	hostsFn := hostsConfigFile(fn)
+	rawHostsRoot, err := rawRootOrBlank(hostsFn)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := runMigrations(fn, hostsFn, rawMainRoot, rawHostsRoot); err != nil {
+		return nil, err
+	}
+
+	mainRoot, err := resolveIncludes(fn, rawMainRoot, map[string]bool{filepath.Clean(fn): true}, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	mainMap := mainRoot.Content[0]
+
+	hostsRoot, err := resolveIncludes(hostsFn, rawHostsRoot, map[string]bool{filepath.Clean(hostsFn): true}, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	hostsMap := hostsRoot.Content[0]
+
+	if hostsEntry, err := findEntry(mainMap, "hosts"); err == nil {
+		hostsMap.Content = append(hostsMap.Content, hostsEntry.Content...)
+		removeEntry(mainMap, "hosts")
+	}
+
+	return &Config{root: mainRoot, hostsRoot: hostsRoot, path: fn}, nil
+}
+
+// Get looks up key for host, resolving against that host's active user (see
+// Users/SetActiveUser) and falling back to the top-level config.yml value
+// when neither has it. For oauth_token, the value held by hosts.yml may be a
+// credential store sentinel rather than the token itself; see
+// resolveCredential.
+func (c *Config) Get(hostname, key string) (string, error) {
+	if key == "oauth_token" {
+		if token := envTokenForHost(hostname); token != "" {
+			return token, nil
+		}
+	}
+
+	var userEntry *yaml.Node
+	if hostname != "" {
+		if hostEntry, err := findEntry(c.hostsRoot.Content[0], hostname); err == nil {
+			entry, err := activeUserEntry(hostEntry)
+			if err != nil {
+				return "", fmt.Errorf("could not resolve active user for %q: %w", hostname, err)
+			}
+			userEntry = entry
+		}
+	}
+
+	return c.getFromEntry(hostname, userEntry, key)
+}
+
+func (c *Config) getFromEntry(hostname string, entry *yaml.Node, key string) (string, error) {
+	if entry != nil {
+		if val, err := findEntry(entry, key); err == nil {
+			if key == "oauth_token" {
+				return c.resolveCredential(hostname, val)
+			}
+			return val.Value, nil
+		}
+	}
+
+	if val, err := findEntry(c.root.Content[0], key); err == nil {
+		return val.Value, nil
+	}
+	if key == "git_protocol" {
+		return defaultGitProtocol, nil
+	}
+	if key == "oauth_token" {
+		if token, err := c.defaultStoreToken(hostname); err == nil {
+			return token, nil
+		}
+	}
+	return "", fmt.Errorf("could not find key %q for %q", key, hostname)
+}
+
+func (c *Config) writeHosts() error {
+	data, err := yaml.Marshal(c.hostsRoot.Content[0])
+	if err != nil {
+		return err
+	}
+	return WriteConfigFile(hostsConfigFile(c.path), data)
+}
+
+func homeDirConfigDir() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".config", "gh")
+}
+
+// migrateConfigDir is a var so tests can stub out the filesystem migration.
+var migrateConfigDir = autoMigrateConfigDir
+
+// ConfigDir returns the directory that gh reads/writes its configuration
+// from, honoring GH_CONFIG_DIR, XDG_CONFIG_HOME and (on Windows) AppData, in
+// that order of precedence.
+func ConfigDir() string {
+	var path string
+	if a := os.Getenv("GH_CONFIG_DIR"); a != "" {
+		path = a
+	} else if b := os.Getenv("XDG_CONFIG_HOME"); b != "" {
+		path = filepath.Join(b, "gh")
+	} else if c := os.Getenv("AppData"); runtime.GOOS == "windows" && c != "" {
+		path = filepath.Join(c, "GitHub CLI")
+	} else {
+		path = homeDirConfigDir()
+	}
+
+	migrateConfigDir(path)
+
+	return path
+}
+
+// autoMigrateConfigDir moves a pre-existing config directory at the old,
+// hardcoded `~/.config/gh` location over to newDir the first time gh runs
+// with a non-default config directory configured.
+func autoMigrateConfigDir(newDir string) {
+	oldDir := homeDirConfigDir()
+	if oldDir == newDir {
+		return
+	}
+	if _, err := os.Stat(oldDir); err != nil {
+		return
+	}
+	if _, err := os.Stat(newDir); err == nil {
+		return
+	}
+	_ = os.MkdirAll(filepath.Dir(newDir), 0755)
+	_ = os.Rename(oldDir, newDir)
+}
@@ -7,12 +7,58 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v3"
 )
 
+func stubConfig(main, hosts string) func() {
+	orig := ReadConfigFile
+	ReadConfigFile = func(fn string) ([]byte, error) {
+		if strings.HasSuffix(fn, "hosts.yml") {
+			return []byte(hosts), nil
+		}
+		return []byte(main), nil
+	}
+	return func() {
+		ReadConfigFile = orig
+	}
+}
+
+func stubMigrateConfigDir() func() {
+	orig := migrateConfigDir
+	migrateConfigDir = func(string) {}
+	return func() {
+		migrateConfigDir = orig
+	}
+}
+
+func stubMigrations(ms []Migration) func() {
+	orig := migrations
+	migrations = ms
+	return func() {
+		migrations = orig
+	}
+}
+
+// stubConfigFiles stubs ReadConfigFile with an explicit filename->contents
+// map, for tests that need more than one distinctly-named file (e.g.
+// include: chains).
+func stubConfigFiles(files map[string]string) func() {
+	orig := ReadConfigFile
+	ReadConfigFile = func(fn string) ([]byte, error) {
+		if content, ok := files[fn]; ok {
+			return []byte(content), nil
+		}
+		return nil, os.ErrNotExist
+	}
+	return func() {
+		ReadConfigFile = orig
+	}
+}
+
 func Test_parseConfig(t *testing.T) {
 	defer stubConfig(`---
 hosts:
@@ -116,6 +162,546 @@ github.com:
 	assert.NotContains(t, mainBuf.String(), "oauth_token")
 }
 
+type fakeCredentialStore struct {
+	secrets map[string]string
+}
+
+func (f *fakeCredentialStore) key(host, key string) string {
+	return host + ":" + key
+}
+
+func (f *fakeCredentialStore) Get(host, key string) (string, error) {
+	if v, ok := f.secrets[f.key(host, key)]; ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("no secret for %s", f.key(host, key))
+}
+
+func (f *fakeCredentialStore) Set(host, key, secret string) error {
+	if f.secrets == nil {
+		f.secrets = map[string]string{}
+	}
+	f.secrets[f.key(host, key)] = secret
+	return nil
+}
+
+func stubCredentialStore(store CredentialStore) func() {
+	orig := newCredentialStore
+	newCredentialStore = func(tag, gitHelper string) (CredentialStore, error) {
+		return store, nil
+	}
+	return func() {
+		newCredentialStore = orig
+	}
+}
+
+func Test_parseConfig_credentialStore_keyringSentinel(t *testing.T) {
+	defer stubConfig("", `---
+github.com:
+    user: monalisa
+    oauth_token: !keyring
+`)()
+
+	fake := &fakeCredentialStore{secrets: map[string]string{"github.com:oauth_token": "KEYRING_TOKEN"}}
+	defer stubCredentialStore(fake)()
+
+	config, err := parseConfig("config.yml")
+	assert.NoError(t, err)
+	token, err := config.Get("github.com", "oauth_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "KEYRING_TOKEN", token)
+}
+
+func Test_parseConfig_credentialStore_gitCredentialSentinel(t *testing.T) {
+	defer stubConfig("", `---
+github.com:
+    user: monalisa
+    oauth_token: !git-credential
+`)()
+
+	fake := &fakeCredentialStore{secrets: map[string]string{"github.com:oauth_token": "GITCRED_TOKEN"}}
+	defer stubCredentialStore(fake)()
+
+	config, err := parseConfig("config.yml")
+	assert.NoError(t, err)
+	token, err := config.Get("github.com", "oauth_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "GITCRED_TOKEN", token)
+}
+
+func Test_parseConfig_credentialStore_envTokenWins(t *testing.T) {
+	defer stubConfig("", `---
+github.com:
+    user: monalisa
+    oauth_token: !keyring
+`)()
+
+	fake := &fakeCredentialStore{secrets: map[string]string{"github.com:oauth_token": "KEYRING_TOKEN"}}
+	defer stubCredentialStore(fake)()
+
+	old := os.Getenv("GH_TOKEN")
+	os.Setenv("GH_TOKEN", "ENV_TOKEN")
+	defer os.Setenv("GH_TOKEN", old)
+
+	config, err := parseConfig("config.yml")
+	assert.NoError(t, err)
+	token, err := config.Get("github.com", "oauth_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "ENV_TOKEN", token)
+}
+
+func Test_parseConfig_credentialStore_migratesPlaintext(t *testing.T) {
+	defer stubConfig(`---
+credential_store: keyring
+`, `---
+github.com:
+    user: monalisa
+    oauth_token: OTOKEN
+`)()
+
+	mainBuf := bytes.Buffer{}
+	hostsBuf := bytes.Buffer{}
+	defer StubWriteConfig(&mainBuf, &hostsBuf)()
+	defer StubBackupConfig()()
+
+	fake := &fakeCredentialStore{}
+	defer stubCredentialStore(fake)()
+
+	config, err := parseConfig("config.yml")
+	assert.NoError(t, err)
+
+	// parseConfig's own schema_version stamping (see migrations.go) may have
+	// already rewritten hosts.yml once, with the token still in plaintext;
+	// only resolveCredential's write, triggered by Get below, is under test.
+	hostsBuf.Reset()
+
+	token, err := config.Get("github.com", "oauth_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "OTOKEN", token)
+
+	stored, err := fake.Get("github.com", "oauth_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "OTOKEN", stored)
+
+	assert.Contains(t, hostsBuf.String(), "!keyring")
+	assert.NotContains(t, hostsBuf.String(), "OTOKEN")
+}
+
+func Test_parseConfig_credentialStore_noSentinelFallsBackToDefaultStore(t *testing.T) {
+	defer stubConfig(`---
+credential_store: keyring
+`, `---
+github.com:
+    user: monalisa
+`)()
+
+	fake := &fakeCredentialStore{secrets: map[string]string{"github.com:oauth_token": "KEYRING_TOKEN"}}
+	defer stubCredentialStore(fake)()
+
+	config, err := parseConfig("config.yml")
+	assert.NoError(t, err)
+	token, err := config.Get("github.com", "oauth_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "KEYRING_TOKEN", token)
+}
+
+func Test_parseConfig_multipleAccounts(t *testing.T) {
+	defer stubConfig("", `---
+github.com:
+    active: work
+    users:
+        personal:
+            oauth_token: T1
+            git_protocol: ssh
+        work:
+            oauth_token: T2
+            git_protocol: https
+`)()
+
+	config, err := parseConfig("config.yml")
+	assert.NoError(t, err)
+
+	token, err := config.Get("github.com", "oauth_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "T2", token)
+
+	protocol, err := config.Get("github.com", "git_protocol")
+	assert.NoError(t, err)
+	assert.Equal(t, "https", protocol)
+
+	users, err := config.Users("github.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"personal", "work"}, users)
+
+	personalToken, err := config.GetForUser("github.com", "personal", "oauth_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "T1", personalToken)
+}
+
+func Test_parseConfig_multipleAccounts_hostFallback(t *testing.T) {
+	defer stubConfig(`---
+git_protocol: ssh
+`, `---
+github.com:
+    active: work
+    users:
+        personal:
+            oauth_token: T1
+        work:
+            oauth_token: T2
+`)()
+
+	config, err := parseConfig("config.yml")
+	assert.NoError(t, err)
+
+	val, err := config.Get("github.com", "git_protocol")
+	assert.NoError(t, err)
+	assert.Equal(t, "ssh", val)
+
+	val, err = config.GetForUser("github.com", "personal", "git_protocol")
+	assert.NoError(t, err)
+	assert.Equal(t, "ssh", val)
+}
+
+func Test_parseConfig_setActiveUser_roundTrip(t *testing.T) {
+	defer stubConfig("", `---
+github.com:
+    active: personal
+    users:
+        personal:
+            oauth_token: T1
+        work:
+            oauth_token: T2
+`)()
+
+	config, err := parseConfig("config.yml")
+	assert.NoError(t, err)
+
+	token, err := config.Get("github.com", "oauth_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "T1", token)
+
+	assert.NoError(t, config.SetActiveUser("github.com", "work"))
+
+	hostsBuf := bytes.Buffer{}
+	defer StubWriteConfig(ioutil.Discard, &hostsBuf)()
+	assert.NoError(t, config.writeHosts())
+
+	defer stubConfig("", hostsBuf.String())()
+	reread, err := parseConfig("config.yml")
+	assert.NoError(t, err)
+
+	token, err = reread.Get("github.com", "oauth_token")
+	assert.NoError(t, err)
+	assert.Equal(t, "T2", token)
+}
+
+func Test_parseConfig_multipleAccounts_danglingActiveUser(t *testing.T) {
+	defer stubConfig(`---
+git_protocol: ssh
+`, `---
+github.com:
+    active: doesnotexist
+    users:
+        personal:
+            oauth_token: T1
+            git_protocol: https
+`)()
+
+	config, err := parseConfig("config.yml")
+	assert.NoError(t, err)
+
+	_, err = config.Get("github.com", "git_protocol")
+	assert.Error(t, err)
+}
+
+func Test_parseConfigFile_include_simple(t *testing.T) {
+	defer stubConfigFiles(map[string]string{
+		"config.yml": `---
+include: enterprise.yml
+git_protocol: ssh
+`,
+		"enterprise.yml": `---
+editor: vim
+git_protocol: https
+`,
+	})()
+
+	_, root, err := parseConfigFile("config.yml")
+	assert.NoError(t, err)
+	mapNode := root.Content[0]
+
+	val, err := findEntry(mapNode, "editor")
+	assert.NoError(t, err)
+	assert.Equal(t, "vim", val.Value)
+
+	// the includer's own value takes precedence over the included one
+	val, err = findEntry(mapNode, "git_protocol")
+	assert.NoError(t, err)
+	assert.Equal(t, "ssh", val.Value)
+
+	_, err = findEntry(mapNode, "include")
+	assert.Error(t, err)
+}
+
+func Test_parseConfigFile_include_nested(t *testing.T) {
+	defer stubConfigFiles(map[string]string{
+		"config.yml": `---
+include: team.yml
+`,
+		"team.yml": `---
+include: base.yml
+editor: vim
+`,
+		"base.yml": `---
+editor: nano
+git_protocol: https
+`,
+	})()
+
+	_, root, err := parseConfigFile("config.yml")
+	assert.NoError(t, err)
+	mapNode := root.Content[0]
+
+	val, err := findEntry(mapNode, "editor")
+	assert.NoError(t, err)
+	assert.Equal(t, "vim", val.Value)
+
+	val, err = findEntry(mapNode, "git_protocol")
+	assert.NoError(t, err)
+	assert.Equal(t, "https", val.Value)
+}
+
+func Test_parseConfigFile_include_cycle(t *testing.T) {
+	defer stubConfigFiles(map[string]string{
+		"config.yml": `---
+include: a.yml
+`,
+		"a.yml": `---
+include: config.yml
+`,
+	})()
+
+	_, _, err := parseConfigFile("config.yml")
+	assert.Error(t, err)
+}
+
+func Test_parseConfigFile_include_missing(t *testing.T) {
+	defer stubConfigFiles(map[string]string{
+		"config.yml": `---
+include: missing.yml
+editor: vim
+`,
+	})()
+
+	_, root, err := parseConfigFile("config.yml")
+	assert.NoError(t, err)
+	val, err := findEntry(root.Content[0], "editor")
+	assert.NoError(t, err)
+	assert.Equal(t, "vim", val.Value)
+	_, err = findEntry(root.Content[0], "strict_includes")
+	assert.Error(t, err)
+}
+
+func Test_parseConfigFile_include_missing_strict(t *testing.T) {
+	defer stubConfigFiles(map[string]string{
+		"config.yml": `---
+strict_includes: true
+include: missing.yml
+editor: vim
+`,
+	})()
+
+	_, _, err := parseConfigFile("config.yml")
+	assert.Error(t, err)
+}
+
+func setMarkerMigration(from, to int, marker string) Migration {
+	return Migration{
+		FromVersion: from,
+		ToVersion:   to,
+		Apply: func(mainRoot, hostsRoot *yaml.Node) error {
+			mainRoot.Content[0].Content = append(mainRoot.Content[0].Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: marker},
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: "true"},
+			)
+			return nil
+		},
+	}
+}
+
+func failingMigration(from, to int) Migration {
+	return Migration{
+		FromVersion: from,
+		ToVersion:   to,
+		Apply: func(mainRoot, hostsRoot *yaml.Node) error {
+			return fmt.Errorf("boom")
+		},
+	}
+}
+
+func Test_runMigrations_chainEndToEnd(t *testing.T) {
+	defer stubMigrations([]Migration{
+		setMarkerMigration(0, 1, "step1"),
+		setMarkerMigration(1, 2, "step2"),
+	})()
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.yml")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("git_protocol: ssh\n"), 0600))
+
+	_, err := parseConfig(fn)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(fn)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "schema_version: 2")
+	assert.Contains(t, string(data), "step1: true")
+	assert.Contains(t, string(data), "step2: true")
+}
+
+func Test_runMigrations_backupRotation(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.yml")
+
+	for i := 1; i <= maxConfigBackups+2; i++ {
+		defer stubMigrations([]Migration{setMarkerMigration(0, 1, fmt.Sprintf("step%d", i))})()
+		assert.NoError(t, ioutil.WriteFile(fn, []byte("git_protocol: ssh\n"), 0600))
+		_, err := parseConfig(fn)
+		assert.NoError(t, err)
+	}
+
+	for i := 1; i <= maxConfigBackups; i++ {
+		_, err := os.Stat(fmt.Sprintf("%s.bak.%d", fn, i))
+		assert.NoError(t, err)
+	}
+	_, err := os.Stat(fmt.Sprintf("%s.bak.%d", fn, maxConfigBackups+1))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_runMigrations_midChainFailureLeavesFileUntouched(t *testing.T) {
+	defer stubMigrations([]Migration{
+		setMarkerMigration(0, 1, "step1"),
+		failingMigration(1, 2),
+	})()
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.yml")
+	original := "git_protocol: ssh\n"
+	assert.NoError(t, ioutil.WriteFile(fn, []byte(original), 0600))
+
+	_, err := parseConfig(fn)
+	assert.Error(t, err)
+
+	data, err := ioutil.ReadFile(fn)
+	assert.NoError(t, err)
+	assert.Equal(t, original, string(data))
+
+	_, err = os.Stat(fn + ".bak.1")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_runMigrations_alreadyAtNewestVersion_isNoop(t *testing.T) {
+	defer stubMigrations([]Migration{
+		setMarkerMigration(0, 1, "step1"),
+	})()
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.yml")
+	original := "schema_version: 1\ngit_protocol: ssh\n"
+	assert.NoError(t, ioutil.WriteFile(fn, []byte(original), 0600))
+
+	_, err := parseConfig(fn)
+	assert.NoError(t, err)
+
+	data, err := ioutil.ReadFile(fn)
+	assert.NoError(t, err)
+	assert.Equal(t, original, string(data))
+
+	_, err = os.Stat(fn + ".bak.1")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_runMigrations_hostsWriteFailureLeavesSchemaVersionUntouched(t *testing.T) {
+	defer stubMigrations([]Migration{
+		setMarkerMigration(0, 1, "step1"),
+	})()
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.yml")
+	hostsFn := filepath.Join(dir, "hosts.yml")
+	original := "git_protocol: ssh\n"
+	assert.NoError(t, ioutil.WriteFile(fn, []byte(original), 0600))
+	assert.NoError(t, ioutil.WriteFile(hostsFn, []byte("github.com:\n    oauth_token: OTOKEN\n"), 0600))
+
+	orig := WriteConfigFile
+	WriteConfigFile = func(fn string, data []byte) error {
+		if strings.HasSuffix(fn, "hosts.yml") {
+			return fmt.Errorf("disk full")
+		}
+		return orig(fn, data)
+	}
+	defer func() { WriteConfigFile = orig }()
+
+	_, err := parseConfig(fn)
+	assert.Error(t, err)
+
+	data, err := ioutil.ReadFile(fn)
+	assert.NoError(t, err)
+	assert.Equal(t, original, string(data))
+}
+
+func Test_runMigrations_mainWriteFailureLeavesOriginalFileInPlace(t *testing.T) {
+	defer stubMigrations([]Migration{
+		setMarkerMigration(0, 1, "step1"),
+	})()
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.yml")
+	original := "git_protocol: ssh\n"
+	assert.NoError(t, ioutil.WriteFile(fn, []byte(original), 0600))
+
+	orig := WriteConfigFile
+	WriteConfigFile = func(fn string, data []byte) error {
+		if strings.HasSuffix(fn, "config.yml") {
+			return fmt.Errorf("disk full")
+		}
+		return orig(fn, data)
+	}
+	defer func() { WriteConfigFile = orig }()
+
+	_, err := parseConfig(fn)
+	assert.Error(t, err)
+
+	data, err := ioutil.ReadFile(fn)
+	assert.NoError(t, err)
+	assert.Equal(t, original, string(data))
+}
+
+func Test_parseConfig_migration_preservesIncludeDirective(t *testing.T) {
+	defer stubMigrations([]Migration{
+		setMarkerMigration(0, 1, "step1"),
+	})()
+
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "config.yml")
+	enterpriseFn := filepath.Join(dir, "enterprise.yml")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("include: enterprise.yml\ngit_protocol: ssh\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(enterpriseFn, []byte("editor: vim\n"), 0600))
+
+	config, err := parseConfig(fn)
+	assert.NoError(t, err)
+
+	editor, err := config.Get("", "editor")
+	assert.NoError(t, err)
+	assert.Equal(t, "vim", editor)
+
+	data, err := ioutil.ReadFile(fn)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "include: enterprise.yml")
+	assert.NotContains(t, string(data), "editor: vim")
+}
+
 func Test_parseConfigFile(t *testing.T) {
 	tests := []struct {
 		contents string
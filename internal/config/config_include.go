@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxIncludeDepth bounds how many levels of include: a single file may pull
+// in, as a backstop against runaway (if not outright cyclical) chains.
+const maxIncludeDepth = 10
+
+// resolveIncludes walks the "include:" directive (if any) of root, a
+// document parsed from fn, loading each referenced file relative to fn's
+// directory and merging it in with "later wins" semantics: an included
+// file's values are overridden by anything root defines directly, mirroring
+// git's own [include] mechanism. visited tracks the chain of files already
+// being resolved, to detect cycles.
+//
+// strict controls what happens when an include: path doesn't exist: warn
+// and skip it (the default), or fail the parse outright. It's inherited by
+// nested includes, but a document may set its own top-level
+// `strict_includes: true` (read here, like "include" itself a directive
+// rather than config data) to override it for its own include: entries and
+// everything they in turn pull in.
+func resolveIncludes(fn string, root *yaml.Node, visited map[string]bool, depth int, strict bool) (*yaml.Node, error) {
+	mapNode := root.Content[0]
+
+	if strictEntry, err := findEntry(mapNode, "strict_includes"); err == nil {
+		removeEntry(mapNode, "strict_includes")
+		if v, err := strconv.ParseBool(strictEntry.Value); err == nil {
+			strict = v
+		}
+	}
+
+	includeEntry, err := findEntry(mapNode, "include")
+	if err != nil {
+		return root, nil
+	}
+	removeEntry(mapNode, "include")
+
+	if depth >= maxIncludeDepth {
+		return nil, fmt.Errorf("config include depth exceeded %d while processing %s", maxIncludeDepth, fn)
+	}
+
+	paths, err := includePaths(includeEntry)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	dir := filepath.Dir(fn)
+	merged := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, p := range paths {
+		includeFn := p
+		if !filepath.IsAbs(includeFn) {
+			includeFn = filepath.Join(dir, includeFn)
+		}
+		cleanFn := filepath.Clean(includeFn)
+
+		if visited[cleanFn] {
+			return nil, fmt.Errorf("include cycle detected: %s includes %s, which is already being processed", fn, cleanFn)
+		}
+
+		data, err := ReadConfigFile(includeFn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				if strict {
+					return nil, fmt.Errorf("%s: included file not found: %s", fn, includeFn)
+				}
+				fmt.Fprintf(os.Stderr, "warning: %s: included file not found: %s\n", fn, includeFn)
+				continue
+			}
+			return nil, err
+		}
+
+		childRoot, err := parseConfigData(data)
+		if err != nil {
+			if err == errEmptyConfig {
+				continue
+			}
+			return nil, err
+		}
+
+		childVisited := make(map[string]bool, len(visited)+1)
+		for k := range visited {
+			childVisited[k] = true
+		}
+		childVisited[cleanFn] = true
+
+		childRoot, err = resolveIncludes(includeFn, childRoot, childVisited, depth+1, strict)
+		if err != nil {
+			return nil, err
+		}
+
+		mergeMappingNode(merged, childRoot.Content[0])
+	}
+
+	mergeMappingNode(merged, mapNode)
+
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{merged}}, nil
+}
+
+// includePaths normalizes the value of an "include:" key, which may be
+// either a single path or a list of paths.
+func includePaths(node *yaml.Node) ([]string, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return []string{node.Value}, nil
+	case yaml.SequenceNode:
+		paths := make([]string, 0, len(node.Content))
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("include: expected a string or a list of strings")
+			}
+			paths = append(paths, item.Value)
+		}
+		return paths, nil
+	default:
+		return nil, fmt.Errorf("include: expected a string or a list of strings")
+	}
+}
+
+// mergeMappingNode merges src into dest: scalars and mismatched-kind values
+// in src overwrite dest's, mapping values are merged recursively, and
+// sequence values are concatenated.
+func mergeMappingNode(dest, src *yaml.Node) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key := src.Content[i]
+		val := src.Content[i+1]
+
+		existing, err := findEntry(dest, key.Value)
+		if err != nil {
+			dest.Content = append(dest.Content, key, val)
+			continue
+		}
+
+		switch {
+		case existing.Kind == yaml.MappingNode && val.Kind == yaml.MappingNode:
+			mergeMappingNode(existing, val)
+		case existing.Kind == yaml.SequenceNode && val.Kind == yaml.SequenceNode:
+			existing.Content = append(existing.Content, val.Content...)
+		default:
+			*existing = *val
+		}
+	}
+}
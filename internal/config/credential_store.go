@@ -0,0 +1,198 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultHostname = "github.com"
+
+	keyringSentinelTag       = "!keyring"
+	gitCredentialSentinelTag = "!git-credential"
+
+	keyringService = "gh:go-gh"
+)
+
+// CredentialStore persists and retrieves secrets (currently just
+// oauth_token) on behalf of a host, keeping them out of the plaintext
+// hosts.yml file.
+type CredentialStore interface {
+	Get(host, key string) (string, error)
+	Set(host, key, secret string) error
+}
+
+// newCredentialStore is a var so tests can substitute an in-memory fake
+// instead of talking to a real OS keyring or git credential helper.
+var newCredentialStore = func(tag, gitHelper string) (CredentialStore, error) {
+	switch tag {
+	case keyringSentinelTag:
+		return keyringStore{}, nil
+	case gitCredentialSentinelTag:
+		return gitCredentialStore{helper: gitHelper}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized credential store sentinel %q", tag)
+	}
+}
+
+// keyringStore backs a CredentialStore with the OS-native secret store:
+// macOS Keychain, Windows Credential Manager, or libsecret/gnome-keyring on
+// Linux.
+type keyringStore struct{}
+
+func (keyringStore) Get(host, key string) (string, error) {
+	return keyring.Get(keyringService, credentialName(host, key))
+}
+
+func (keyringStore) Set(host, key, secret string) error {
+	return keyring.Set(keyringService, credentialName(host, key), secret)
+}
+
+func credentialName(host, key string) string {
+	return fmt.Sprintf("%s:%s", host, key)
+}
+
+// gitCredentialStore shells out to a `git credential`-compatible helper to
+// resolve and persist secrets, the same mechanism git itself uses for HTTPS
+// auth.
+type gitCredentialStore struct {
+	helper string // credential helper binary; defaults to "git"
+}
+
+func (s gitCredentialStore) bin() string {
+	if s.helper != "" {
+		return s.helper
+	}
+	return "git"
+}
+
+func (s gitCredentialStore) Get(host, key string) (string, error) {
+	if key != "oauth_token" {
+		return "", fmt.Errorf("git credential store does not support key %q", key)
+	}
+	cmd := exec.Command(s.bin(), "credential", "fill")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=https\nhost=%s\n\n", host))
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git credential fill for %q: %w", host, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if v := strings.TrimPrefix(line, "password="); v != line {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("git credential fill returned no password for %q", host)
+}
+
+func (s gitCredentialStore) Set(host, key, secret string) error {
+	if key != "oauth_token" {
+		return fmt.Errorf("git credential store does not support key %q", key)
+	}
+	cmd := exec.Command(s.bin(), "credential", "approve")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=https\nhost=%s\nusername=x-access-token\npassword=%s\n\n", host, secret))
+	return cmd.Run()
+}
+
+// envTokenForHost returns the token supplied via GH_TOKEN/GITHUB_TOKEN (for
+// github.com) or GH_ENTERPRISE_TOKEN/GITHUB_ENTERPRISE_TOKEN (for any other
+// host), or "" if none is set.
+func envTokenForHost(host string) string {
+	if host == "" || host == defaultHostname {
+		if t := os.Getenv("GH_TOKEN"); t != "" {
+			return t
+		}
+		return os.Getenv("GITHUB_TOKEN")
+	}
+	if t := os.Getenv("GH_ENTERPRISE_TOKEN"); t != "" {
+		return t
+	}
+	return os.Getenv("GITHUB_ENTERPRISE_TOKEN")
+}
+
+func (c *Config) gitCredentialHelper() string {
+	if val, err := findEntry(c.root.Content[0], "git_credential_helper"); err == nil {
+		return val.Value
+	}
+	return ""
+}
+
+// defaultCredentialStoreTag reports the sentinel tag for the store named by
+// the top-level `credential_store:` key in config.yml, or "" if unset.
+func (c *Config) defaultCredentialStoreTag() string {
+	val, err := findEntry(c.root.Content[0], "credential_store")
+	if err != nil {
+		return ""
+	}
+	switch val.Value {
+	case "keyring":
+		return keyringSentinelTag
+	case "git-credential":
+		return gitCredentialSentinelTag
+	default:
+		return ""
+	}
+}
+
+// defaultStoreToken looks up oauth_token for host directly in the system
+// default credential store configured via the top-level `credential_store:`
+// key, for the case where hosts.yml holds no oauth_token entry for host at
+// all (e.g. it was written straight into the store with no sentinel left
+// behind). It errors if no default store is configured.
+func (c *Config) defaultStoreToken(host string) (string, error) {
+	tag := c.defaultCredentialStoreTag()
+	if tag == "" {
+		return "", fmt.Errorf("no default credential store configured")
+	}
+	store, err := newCredentialStore(tag, c.gitCredentialHelper())
+	if err != nil {
+		return "", err
+	}
+	return store.Get(host, "oauth_token")
+}
+
+// resolveCredential resolves the value held by an oauth_token node in
+// hosts.yml. A recognized sentinel tag (!keyring, !git-credential) is
+// resolved against the matching CredentialStore. A plaintext value is
+// returned as-is, with a deprecation warning, and transparently migrated
+// into the configured default store (if any) so it isn't read back in
+// plaintext again.
+func (c *Config) resolveCredential(host string, node *yaml.Node) (string, error) {
+	if node.Tag == keyringSentinelTag || node.Tag == gitCredentialSentinelTag {
+		store, err := newCredentialStore(node.Tag, c.gitCredentialHelper())
+		if err != nil {
+			return "", err
+		}
+		return store.Get(host, "oauth_token")
+	}
+
+	token := node.Value
+
+	tag := c.defaultCredentialStoreTag()
+	if tag == "" {
+		fmt.Fprintf(os.Stderr, "warning: oauth_token for %q is stored in plaintext in hosts.yml; set `credential_store` in config.yml to use a secure store\n", host)
+		return token, nil
+	}
+
+	store, err := newCredentialStore(tag, c.gitCredentialHelper())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not migrate oauth_token for %q into %s: %s\n", host, tag, err)
+		return token, nil
+	}
+	if err := store.Set(host, "oauth_token", token); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: could not migrate oauth_token for %q into %s: %s\n", host, tag, err)
+		return token, nil
+	}
+
+	node.Value = ""
+	node.Tag = tag
+	if err := c.writeHosts(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: migrated oauth_token for %q into %s but failed to update hosts.yml: %s\n", host, tag, err)
+	}
+
+	return token, nil
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Migration describes a single schema upgrade step for config.yml/hosts.yml,
+// from FromVersion to ToVersion. Apply mutates mainRoot and hostsRoot (both
+// full yaml.v3 documents, i.e. Content[0] is the top-level mapping) in
+// place.
+type Migration struct {
+	FromVersion int
+	ToVersion   int
+	Apply       func(mainRoot, hostsRoot *yaml.Node) error
+}
+
+// migrations is the registered, ordered chain of schema upgrades. Each one
+// is expected to pick up exactly where the previous one's ToVersion left
+// off; runMigrations walks them in order starting from whatever
+// schema_version it finds in config.yml (0 if unset).
+var migrations = []Migration{
+	{
+		FromVersion: 0,
+		ToVersion:   1,
+		Apply:       migrateHostsList,
+	},
+}
+
+const schemaVersionKey = "schema_version"
+
+// migrateHostsList is the original ad hoc migration: it pulls the legacy
+// "host: [ {user, oauth_token} ]" shape out of config.yml, from before
+// hosts.yml was split into its own file, and folds it into hosts.yml.
+func migrateHostsList(mainRoot, hostsRoot *yaml.Node) error {
+	fragment, _, err := migrateConfig(mainRoot)
+	if err != nil {
+		return err
+	}
+	hostsRoot.Content[0].Content = append(hostsRoot.Content[0].Content, fragment.Content...)
+	return nil
+}
+
+func schemaVersion(mainMap *yaml.Node) int {
+	val, err := findEntry(mainMap, schemaVersionKey)
+	if err != nil {
+		return 0
+	}
+	v, err := strconv.Atoi(val.Value)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+func setSchemaVersion(mainMap *yaml.Node, version int) {
+	versionNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(version)}
+	if val, err := findEntry(mainMap, schemaVersionKey); err == nil {
+		*val = *versionNode
+		return
+	}
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: schemaVersionKey}
+	mainMap.Content = append([]*yaml.Node{keyNode, versionNode}, mainMap.Content...)
+}
+
+// runMigrations advances mainRoot/hostsRoot through every registered
+// Migration whose FromVersion picks up where the previous one (or the
+// document's current schema_version) left off. If any migration in the
+// chain fails, mainRoot/hostsRoot are left partially mutated in memory but
+// fn/hostsFn on disk are untouched, since nothing is written until the
+// whole chain succeeds. Returns whether anything was migrated.
+//
+// hosts.yml is written before config.yml's schema_version is bumped: if the
+// process dies between the two writes, the on-disk schema_version still
+// describes the (unmigrated) hosts.yml, so the next parseConfig retries the
+// migration instead of skipping it as already done.
+func runMigrations(fn, hostsFn string, mainRoot, hostsRoot *yaml.Node) (bool, error) {
+	mainMap := mainRoot.Content[0]
+	version := schemaVersion(mainMap)
+
+	migrated := false
+	for _, m := range migrations {
+		if m.FromVersion != version {
+			continue
+		}
+		if err := m.Apply(mainRoot, hostsRoot); err != nil {
+			return false, fmt.Errorf("config migration %d -> %d failed: %w", m.FromVersion, m.ToVersion, err)
+		}
+		version = m.ToVersion
+		migrated = true
+	}
+
+	if !migrated {
+		return false, nil
+	}
+
+	hostsData, err := yaml.Marshal(hostsRoot.Content[0])
+	if err != nil {
+		return false, err
+	}
+	if err := WriteConfigFile(hostsFn, hostsData); err != nil {
+		return false, err
+	}
+
+	// Only back up and overwrite config.yml itself once hosts.yml has safely
+	// landed on disk, so a failure here can never leave fn ahead of the
+	// hosts.yml content it claims to describe.
+	if err := BackupConfigFile(fn); err != nil && !os.IsNotExist(err) {
+		return false, fmt.Errorf("failed to back up existing config: %w", err)
+	}
+
+	setSchemaVersion(mainMap, version)
+
+	mainData, err := yaml.Marshal(mainRoot)
+	if err != nil {
+		return false, err
+	}
+	if err := WriteConfigFile(fn, mainData); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A host entry in hosts.yml is either the legacy single-account form:
+//
+//   github.com:
+//     user: monalisa
+//     oauth_token: TOKEN
+//
+// or the multi-account form:
+//
+//   github.com:
+//     active: work
+//     users:
+//       personal:
+//         oauth_token: T1
+//       work:
+//         oauth_token: T2
+
+// hostUsersMap returns the "users" mapping node for hostEntry in
+// multi-account form, or nil if hostEntry is in the legacy single-account
+// form.
+func hostUsersMap(hostEntry *yaml.Node) *yaml.Node {
+	if hostEntry == nil {
+		return nil
+	}
+	if val, err := findEntry(hostEntry, "users"); err == nil && val.Kind == yaml.MappingNode {
+		return val
+	}
+	return nil
+}
+
+// legacyUserName returns the account name implied by the legacy
+// single-account host form (its "user" value), or "" if hostEntry has no
+// such value.
+func legacyUserName(hostEntry *yaml.Node) string {
+	if val, err := findEntry(hostEntry, "user"); err == nil {
+		return val.Value
+	}
+	return ""
+}
+
+// activeUserEntry returns the mapping node for hostEntry's active account:
+// hostEntry itself for the legacy single-account form, or the selected
+// entry under "users" for the multi-account form.
+func activeUserEntry(hostEntry *yaml.Node) (*yaml.Node, error) {
+	if hostEntry == nil {
+		return nil, fmt.Errorf("no such host")
+	}
+	users := hostUsersMap(hostEntry)
+	if users == nil {
+		return hostEntry, nil
+	}
+
+	name := ""
+	if val, err := findEntry(hostEntry, "active"); err == nil {
+		name = val.Value
+	}
+	if name == "" && len(users.Content) == 2 {
+		name = users.Content[0].Value
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no active user set")
+	}
+
+	entry, err := findEntry(users, name)
+	if err != nil {
+		return nil, fmt.Errorf("active user %q not found", name)
+	}
+	return entry, nil
+}
+
+// namedUserEntry returns the mapping node for the given account under
+// hostEntry, regardless of whether hostEntry is in legacy or multi-account
+// form.
+func namedUserEntry(hostEntry *yaml.Node, user string) (*yaml.Node, error) {
+	if users := hostUsersMap(hostEntry); users != nil {
+		entry, err := findEntry(users, user)
+		if err != nil {
+			return nil, fmt.Errorf("user %q is not configured", user)
+		}
+		return entry, nil
+	}
+	if legacyUserName(hostEntry) == user {
+		return hostEntry, nil
+	}
+	return nil, fmt.Errorf("user %q is not configured", user)
+}
+
+// Users returns the account names configured for host: the single implied
+// account for the legacy form, or every key under "users" for the
+// multi-account form.
+func (c *Config) Users(host string) ([]string, error) {
+	hostEntry, err := findEntry(c.hostsRoot.Content[0], host)
+	if err != nil {
+		return nil, fmt.Errorf("no such host %q", host)
+	}
+
+	if users := hostUsersMap(hostEntry); users != nil {
+		names := make([]string, 0, len(users.Content)/2)
+		for i := 0; i+1 < len(users.Content); i += 2 {
+			names = append(names, users.Content[i].Value)
+		}
+		return names, nil
+	}
+
+	if name := legacyUserName(hostEntry); name != "" {
+		return []string{name}, nil
+	}
+	return nil, nil
+}
+
+// SetActiveUser marks user as the active account for host, so that
+// subsequent calls to Get resolve against it. user must already be
+// configured for host.
+func (c *Config) SetActiveUser(host, user string) error {
+	hostEntry, err := findEntry(c.hostsRoot.Content[0], host)
+	if err != nil {
+		return fmt.Errorf("no such host %q", host)
+	}
+
+	users := hostUsersMap(hostEntry)
+	if users == nil {
+		if legacyUserName(hostEntry) != user {
+			return fmt.Errorf("user %q is not configured for %q", user, host)
+		}
+		return nil
+	}
+	if _, err := findEntry(users, user); err != nil {
+		return fmt.Errorf("user %q is not configured for %q", user, host)
+	}
+
+	if activeVal, err := findEntry(hostEntry, "active"); err == nil {
+		activeVal.Value = user
+		return nil
+	}
+	hostEntry.Content = append(hostEntry.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "active"},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: user},
+	)
+	return nil
+}
+
+// GetForUser looks up key for the given account on host, regardless of
+// which account is currently active.
+func (c *Config) GetForUser(host, user, key string) (string, error) {
+	if key == "oauth_token" {
+		if token := envTokenForHost(host); token != "" {
+			return token, nil
+		}
+	}
+
+	hostEntry, err := findEntry(c.hostsRoot.Content[0], host)
+	if err != nil {
+		return "", fmt.Errorf("no such host %q", host)
+	}
+	entry, err := namedUserEntry(hostEntry, user)
+	if err != nil {
+		return "", err
+	}
+
+	return c.getFromEntry(host, entry, key)
+}